@@ -0,0 +1,162 @@
+// Package attachment stores the encrypted bytes of message attachments on
+// disk, keyed by message token. It's modeled on the upload path of the ntfy
+// attachments patch: a size-capped writer guards against oversized uploads
+// while the bytes are still streaming in, and a small peek at the start of
+// the stream is enough to sniff a content type without buffering the whole
+// upload in memory.
+package attachment
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// ErrLimitReached is returned by LimitedWriter once more bytes have been
+// written to it than its Limit allows.
+var ErrLimitReached = errors.New("attachment: size limit reached")
+
+// sniffLen matches the number of bytes http.DetectContentType looks at, so
+// peeking any more than this wouldn't improve the result.
+const sniffLen = 512
+
+// LimitedWriter forwards writes to W, failing with ErrLimitReached once more
+// than Limit bytes have passed through it. A Limit of zero or less means no
+// limit, matching the convention of the other *_limit fields in this repo.
+type LimitedWriter struct {
+	W       io.Writer
+	Limit   int64
+	written int64
+}
+
+func (lw *LimitedWriter) Write(p []byte) (int, error) {
+	if lw.Limit > 0 && lw.written+int64(len(p)) > lw.Limit {
+		return 0, ErrLimitReached
+	}
+
+	n, err := lw.W.Write(p)
+	lw.written += int64(n)
+	return n, err
+}
+
+// sniffContentType peeks at the first sniffLen bytes of r to detect its
+// content type, then returns a reader that replays those bytes before
+// continuing to read from r, so the caller can still consume the stream in
+// full.
+func sniffContentType(r io.Reader) (contentType string, body io.Reader, err error) {
+	peeked := make([]byte, sniffLen)
+	n, err := io.ReadFull(r, peeked)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", nil, err
+	}
+
+	return http.DetectContentType(peeked[:n]), io.MultiReader(bytes.NewReader(peeked[:n]), r), nil
+}
+
+// Cache stores attachment bytes on disk under a single directory, one file
+// per message token.
+type Cache struct {
+	dir string
+}
+
+// NewCache returns a Cache backed by dir, creating it if it doesn't exist
+// yet.
+func NewCache(dir string) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	return &Cache{dir: dir}, nil
+}
+
+// Path returns the on-disk path of the attachment stored under token,
+// regardless of whether it currently exists.
+func (c *Cache) Path(token string) string {
+	return filepath.Join(c.dir, token)
+}
+
+// Save streams r to disk under token, sniffing its content type from the
+// first bytes and enforcing limit as it goes. If limit is exceeded, the
+// partially written file is removed and ErrLimitReached is returned.
+func (c *Cache) Save(token string, r io.Reader, limit int64) (sizeBytes int64, contentType string, err error) {
+	contentType, body, err := sniffContentType(r)
+	if err != nil {
+		return 0, "", err
+	}
+
+	path := c.Path(token)
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+
+	limited := &LimitedWriter{W: f, Limit: limit}
+	sizeBytes, err = io.Copy(limited, body)
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, "", err
+	}
+
+	return sizeBytes, contentType, nil
+}
+
+// Open opens the attachment stored under token for reading.
+func (c *Cache) Open(token string) (*os.File, error) {
+	return os.Open(c.Path(token))
+}
+
+// Delete removes the attachment stored under token, if any. It is not an
+// error for the file to already be gone.
+func (c *Cache) Delete(token string) error {
+	err := os.Remove(c.Path(token))
+	if err != nil && os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// TotalBytes sums the size of every file currently cached on disk, so
+// callers can enforce a total disk usage limit before accepting a new
+// upload.
+func (c *Cache) TotalBytes() (int64, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+
+	return total, nil
+}
+
+// Tokens lists every message token that currently has bytes cached on disk,
+// so a caller can sweep out files that have become orphaned (e.g. their
+// database metadata expired or was already consumed).
+func (c *Cache) Tokens() ([]string, error) {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		tokens = append(tokens, entry.Name())
+	}
+
+	return tokens, nil
+}
@@ -0,0 +1,103 @@
+package attachment
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimitedWriterAllowsUpToLimit(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	lw := &LimitedWriter{W: &buf, Limit: 5}
+
+	n, err := lw.Write([]byte("hello"))
+	assert.Nil(err)
+	assert.Equal(5, n)
+	assert.Equal("hello", buf.String())
+}
+
+func TestLimitedWriterFailsPastLimit(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	lw := &LimitedWriter{W: &buf, Limit: 5}
+
+	_, err := lw.Write([]byte("too long"))
+	assert.ErrorIs(err, ErrLimitReached)
+}
+
+func TestLimitedWriterZeroLimitMeansUnlimited(t *testing.T) {
+	assert := require.New(t)
+
+	var buf bytes.Buffer
+	lw := &LimitedWriter{W: &buf, Limit: 0}
+
+	_, err := lw.Write(bytes.Repeat([]byte("a"), 10000))
+	assert.Nil(err)
+}
+
+func TestSaveDetectsContentTypeAndStoresBytes(t *testing.T) {
+	assert := require.New(t)
+
+	cache, err := NewCache(t.TempDir())
+	assert.Nil(err)
+
+	pngHeader := []byte("\x89PNG\r\n\x1a\n" + "rest of the file")
+	sizeBytes, contentType, err := cache.Save("tok1", bytes.NewReader(pngHeader), 0)
+	assert.Nil(err)
+	assert.Equal(int64(len(pngHeader)), sizeBytes)
+	assert.Equal("image/png", contentType)
+
+	f, err := cache.Open("tok1")
+	assert.Nil(err)
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	assert.Nil(err)
+	assert.Equal(pngHeader, data)
+}
+
+func TestSaveRemovesFileWhenLimitReached(t *testing.T) {
+	assert := require.New(t)
+
+	dir := t.TempDir()
+	cache, err := NewCache(dir)
+	assert.Nil(err)
+
+	_, _, err = cache.Save("tok2", bytes.NewReader(bytes.Repeat([]byte("a"), 1000)), 10)
+	assert.ErrorIs(err, ErrLimitReached)
+
+	_, statErr := os.Stat(filepath.Join(dir, "tok2"))
+	assert.True(os.IsNotExist(statErr))
+}
+
+func TestDeleteIsNotAnErrorWhenMissing(t *testing.T) {
+	assert := require.New(t)
+
+	cache, err := NewCache(t.TempDir())
+	assert.Nil(err)
+
+	assert.Nil(cache.Delete("does-not-exist"))
+}
+
+func TestTokensListsCachedFiles(t *testing.T) {
+	assert := require.New(t)
+
+	cache, err := NewCache(t.TempDir())
+	assert.Nil(err)
+
+	_, _, err = cache.Save("tok3", bytes.NewReader([]byte("some bytes")), 0)
+	assert.Nil(err)
+	_, _, err = cache.Save("tok4", bytes.NewReader([]byte("more bytes")), 0)
+	assert.Nil(err)
+
+	tokens, err := cache.Tokens()
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"tok3", "tok4"}, tokens)
+}
@@ -1,289 +1,670 @@
 package database
 
 import (
+	"database/sql"
+	_ "github.com/mattn/go-sqlite3"
 	"github.com/stretchr/testify/require"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
 const (
 	testDbPath = "./testDb.db"
 )
 
-func dropDatabase(fileName string) {
-	_ = os.Remove(fileName)
+// backend describes one Store implementation to run the test matrix against.
+type backend struct {
+	name string
+	dsn  string
 }
 
-func clearDb() {
-	dropDatabase(testDbPath)
-}
-
-func connectDb(t *testing.T) *OneTimeShareDb {
-	assert := require.New(t)
-	db, err := ConnectDb(testDbPath)
+// backends lists every Store implementation covered by this test file. The
+// sqlite backend always runs against a throwaway file; postgres only runs
+// when TEST_DSN points at a reachable Postgres instance, since CI doesn't
+// have one available by default.
+func backends() []backend {
+	result := []backend{{name: "sqlite3", dsn: "sqlite3:" + testDbPath}}
 
-	if err != nil {
-		assert.Fail("Problem with creation db connection:" + err.Error())
-		return nil
+	if dsn := os.Getenv("TEST_DSN"); dsn != "" {
+		result = append(result, backend{name: "postgres", dsn: dsn})
 	}
-	return db
+
+	return result
 }
 
-func createDbAndConnect(t *testing.T) *OneTimeShareDb {
-	clearDb()
-	return connectDb(t)
+func (b backend) clear() {
+	if b.name == "sqlite3" {
+		_ = os.Remove(testDbPath)
+	}
 }
 
-func TestConnection(t *testing.T) {
+func (b backend) connect(t *testing.T) Store {
 	assert := require.New(t)
-	dropDatabase(testDbPath)
+	store, err := NewStore(b.dsn)
 
-	db, err := ConnectDb(testDbPath)
-
-	defer dropDatabase(testDbPath)
 	if err != nil {
 		assert.Fail("Problem with creation db connection:" + err.Error())
-		return
+		return nil
 	}
-
-	assert.True(db.IsConnectionOpened())
-
-	db.Disconnect()
-
-	assert.False(db.IsConnectionOpened())
+	return store
 }
 
-func TestSanitizeString(t *testing.T) {
-	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-	defer db.Disconnect()
-
-	testText := "text'test''test\"test\\"
-
-	db.SetDatabaseVersion(testText)
-	assert.Equal(testText, db.GetDatabaseVersion())
+func (b backend) createAndConnect(t *testing.T) Store {
+	b.clear()
+	return b.connect(t)
 }
 
-func TestDatabaseVersion(t *testing.T) {
-	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-
-	{
-		version := db.GetDatabaseVersion()
-		assert.Equal(latestVersion, version)
+func forEachBackend(t *testing.T, testFn func(t *testing.T, b backend)) {
+	for _, b := range backends() {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			testFn(t, b)
+		})
 	}
+}
 
-	{
-		db.SetDatabaseVersion("1.0")
-		version := db.GetDatabaseVersion()
-		assert.Equal("1.0", version)
-	}
+func TestConnection(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		b.clear()
 
-	db.Disconnect()
+		store, err := NewStore(b.dsn)
+		defer b.clear()
+		if err != nil {
+			assert.Fail("Problem with creation db connection:" + err.Error())
+			return
+		}
 
-	{
-		db = connectDb(t)
-		version := db.GetDatabaseVersion()
-		assert.Equal("1.0", version)
-		db.Disconnect()
-	}
+		assert.True(store.IsConnectionOpened())
 
-	{
-		db = connectDb(t)
-		db.SetDatabaseVersion("1.2")
-		db.Disconnect()
-	}
+		store.Disconnect()
 
-	{
-		db = connectDb(t)
-		version := db.GetDatabaseVersion()
-		assert.Equal("1.2", version)
-		db.Disconnect()
-	}
+		assert.False(store.IsConnectionOpened())
+	})
 }
 
-func TestGetUserLimits(t *testing.T) {
+func TestConnectDbRetriesOnUnwritablePath(t *testing.T) {
 	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-	defer db.Disconnect()
-
-	var token1 = "321"
-	var token2 = "123"
 
-	{
-		isFound, _, _, _ := db.GetUserLimits(token1)
-		assert.False(isFound)
+	opts := ConnectOptions{
+		MaxAttempts:    4,
+		InitialBackoff: 5 * time.Millisecond,
+		MaxBackoff:     20 * time.Millisecond,
 	}
 
-	assert.False(db.DoesUserExist(token1))
-
-	db.SetUserLimits(token1, 1, 2, 3)
-	assert.True(db.DoesUserExist(token1))
-
-	{
-		isFound, retentionLimitMinutes, maxSizeBytes, shareCreationLimitMinutes := db.GetUserLimits(token1)
+	// "/" is a directory, so opening it as a sqlite file can never succeed;
+	// every attempt fails the same way, so this exercises the full retry loop
+	start := time.Now()
+	_, err := connectSqliteStore("/", opts)
+	elapsed := time.Since(start)
 
-		assert.True(isFound)
-		assert.False(db.DoesUserExist(token2))
-		assert.Equal(1, retentionLimitMinutes)
-		assert.Equal(2, maxSizeBytes)
-		assert.Equal(3, shareCreationLimitMinutes)
-	}
+	assert.NotNil(err)
+	// 3 waits between 4 attempts, at least InitialBackoff+2*InitialBackoff+4*InitialBackoff capped at MaxBackoff
+	assert.GreaterOrEqual(elapsed, opts.InitialBackoff*3)
 }
 
-func TestRemoveUserLimits(t *testing.T) {
-	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-	defer db.Disconnect()
-
-	var token1 = "321"
-	var token2 = "123"
+func TestDatabaseVersion(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+
+		{
+			version := store.GetDatabaseVersion()
+			assert.Equal(latestVersion, version)
+		}
+
+		{
+			store.SetDatabaseVersion("1.0")
+			version := store.GetDatabaseVersion()
+			assert.Equal("1.0", version)
+		}
+
+		store.Disconnect()
+
+		{
+			store = b.connect(t)
+			version := store.GetDatabaseVersion()
+			assert.Equal("1.0", version)
+			store.Disconnect()
+		}
+
+		{
+			store = b.connect(t)
+			store.SetDatabaseVersion("1.2")
+			store.Disconnect()
+		}
+
+		{
+			store = b.connect(t)
+			version := store.GetDatabaseVersion()
+			assert.Equal("1.2", version)
+			store.Disconnect()
+		}
+	})
+}
 
-	db.SetUserLimits(token1, 1, 2, 3)
-	assert.True(db.DoesUserExist(token1))
+func TestAdversarialTokensRoundTrip(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		adversarialTokens := []string{
+			"text'test''test\"test\\",
+			"\"; DROP TABLE users;--",
+			"has\x00a\x00nul",
+			"\U0001F600\U0001F4A9",
+		}
+
+		for _, token := range adversarialTokens {
+			store.SetDatabaseVersion(token)
+			assert.Equal(token, store.GetDatabaseVersion())
+
+			store.SetUserLimits(token, 1, 2, 3, 0, 0)
+			assert.True(store.DoesUserExist(token))
+
+			err := store.SaveMessage(token, token, 100, token, 1)
+			assert.Nil(err)
+			message, expireTimestamp, remainingReads := store.TryConsumeMessage(token)
+			assert.Equal(token, *message)
+			assert.Equal(int64(100), expireTimestamp)
+			assert.Equal(0, remainingReads)
+		}
+	})
+}
 
-	db.RemoveUserByToken(token1)
-	assert.False(db.DoesUserExist(token1))
+func TestGetUserLimits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		var token1 = "321"
+		var token2 = "123"
+
+		{
+			isFound, _, _, _, _, _ := store.GetUserLimits(token1)
+			assert.False(isFound)
+		}
+
+		assert.False(store.DoesUserExist(token1))
+
+		store.SetUserLimits(token1, 1, 2, 3, 4, 5)
+		assert.True(store.DoesUserExist(token1))
+
+		{
+			isFound, retentionLimitMinutes, maxSizeBytes, shareCreationLimitMinutes, maxReadsLimit, maxAttachmentBytes := store.GetUserLimits(token1)
+
+			assert.True(isFound)
+			assert.False(store.DoesUserExist(token2))
+			assert.Equal(1, retentionLimitMinutes)
+			assert.Equal(2, maxSizeBytes)
+			assert.Equal(3, shareCreationLimitMinutes)
+			assert.Equal(4, maxReadsLimit)
+			assert.Equal(int64(5), maxAttachmentBytes)
+		}
+	})
+}
 
-	db.RemoveUserByToken(token2)
-	assert.False(db.DoesUserExist(token2))
+func TestRemoveUserLimits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		var token1 = "321"
+		var token2 = "123"
+
+		store.SetUserLimits(token1, 1, 2, 3, 0, 0)
+		assert.True(store.DoesUserExist(token1))
+
+		store.RemoveUserByToken(token1)
+		assert.False(store.DoesUserExist(token1))
+
+		store.RemoveUserByToken(token2)
+		assert.False(store.DoesUserExist(token2))
+	})
 }
 
 func TestSaveAndConsumeMessage(t *testing.T) {
-	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-	defer db.Disconnect()
-
-	var message1 = "test message 1"
-	var message2 = "test message 2"
-	var message3 = "test message 3"
-
-	var messageToken1 = "321"
-	var messageToken2 = "123"
-
-	err := db.SaveMessage(messageToken1, 100, message1)
-	assert.Nil(err)
-	err = db.SaveMessage(messageToken1, 200, message2)
-	assert.NotNil(err)
-	err = db.SaveMessage(messageToken2, 300, message3)
-	assert.Nil(err)
-
-	{
-		message, expireTimestamp := db.TryConsumeMessage(messageToken1)
-		assert.Equal(message1, *message)
-		assert.Equal(int64(100), expireTimestamp)
-	}
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		var message1 = "test message 1"
+		var message2 = "test message 2"
+		var message3 = "test message 3"
+
+		var messageToken1 = "321"
+		var messageToken2 = "123"
+
+		err := store.SaveMessage(messageToken1, messageToken1, 100, message1, 1)
+		assert.Nil(err)
+		err = store.SaveMessage(messageToken1, messageToken1, 200, message2, 1)
+		assert.NotNil(err)
+		err = store.SaveMessage(messageToken2, messageToken2, 300, message3, 1)
+		assert.Nil(err)
+
+		{
+			message, expireTimestamp, remainingReads := store.TryConsumeMessage(messageToken1)
+			assert.Equal(message1, *message)
+			assert.Equal(int64(100), expireTimestamp)
+			assert.Equal(0, remainingReads)
+		}
+
+		{
+			message, _, _ := store.TryConsumeMessage(messageToken1)
+			assert.Nil(message)
+		}
+
+		{
+			message, expireTimestamp, remainingReads := store.TryConsumeMessage(messageToken2)
+			assert.Equal(message3, *message)
+			assert.Equal(int64(300), expireTimestamp)
+			assert.Equal(0, remainingReads)
+		}
+
+		{
+			message, _, _ := store.TryConsumeMessage(messageToken2)
+			assert.Nil(message)
+		}
+
+		{
+			message, _, _ := store.TryConsumeMessage("not existing token")
+			assert.Nil(message)
+		}
+	})
+}
 
-	{
-		message, _ := db.TryConsumeMessage(messageToken1)
-		assert.Nil(message)
-	}
+func TestSaveAndConsumeMultiReadMessage(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		messageToken := "321"
+		message := "shared with 3 readers"
+
+		err := store.SaveMessage(messageToken, messageToken, 1000, message, 3)
+		assert.Nil(err)
+
+		for expectedRemaining := 2; expectedRemaining >= 0; expectedRemaining-- {
+			data, expireTimestamp, remainingReads := store.TryConsumeMessage(messageToken)
+			assert.Equal(message, *data)
+			assert.Equal(int64(1000), expireTimestamp)
+			assert.Equal(expectedRemaining, remainingReads)
+		}
+
+		// the row is deleted once exhausted
+		data, _, _ := store.TryConsumeMessage(messageToken)
+		assert.Nil(data)
+	})
+}
 
-	{
-		message, expireTimestamp := db.TryConsumeMessage(messageToken2)
-		assert.Equal(message3, *message)
-		assert.Equal(int64(300), expireTimestamp)
-	}
+func TestConcurrentConsumersRaceOnSameToken(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		messageToken := "321"
+		maxReads := 5
+
+		err := store.SaveMessage(messageToken, messageToken, 1000, "racy message", maxReads)
+		assert.Nil(err)
+
+		successCount := 0
+		var mutex sync.Mutex
+		var wg sync.WaitGroup
+		for i := 0; i < maxReads*3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				data, _, _ := store.TryConsumeMessage(messageToken)
+				if data != nil {
+					mutex.Lock()
+					successCount++
+					mutex.Unlock()
+				}
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(maxReads, successCount)
+	})
+}
 
-	{
-		message, _ := db.TryConsumeMessage(messageToken2)
-		assert.Nil(message)
-	}
+func TestClearExpiredMessages(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		var message1 = "test message 1"
+		var message2 = "test message 2"
+
+		var messageToken1 = "321"
+		var messageToken2 = "123"
+
+		err := store.SaveMessage(messageToken1, messageToken1, 100, message1, 1)
+		assert.Nil(err)
+		err = store.SaveMessage(messageToken2, messageToken2, 200, message2, 1)
+		assert.Nil(err)
+
+		expiredTokens := store.ClearExpiredMessages(160)
+		assert.Equal([]string{messageToken1}, expiredTokens)
+
+		{
+			message, _, _ := store.TryConsumeMessage(messageToken1)
+			assert.Nil(message)
+		}
+
+		{
+			message, expireTimestamp, _ := store.TryConsumeMessage(messageToken2)
+			assert.Equal(message2, *message)
+			assert.Equal(int64(200), expireTimestamp)
+		}
+	})
+}
 
-	{
-		message, _ := db.TryConsumeMessage("not existing token")
-		assert.Nil(message)
-	}
+func TestClearExpiredMessagesBeforeExhaustion(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		messageToken := "321"
+		err := store.SaveMessage(messageToken, messageToken, 100, "expires before it's fully read", 5)
+		assert.Nil(err)
+
+		data, _, remainingReads := store.TryConsumeMessage(messageToken)
+		assert.NotNil(data)
+		assert.Equal(4, remainingReads)
+
+		store.ClearExpiredMessages(200)
+
+		data, _, _ = store.TryConsumeMessage(messageToken)
+		assert.Nil(data)
+	})
 }
 
-func TestClearExpiredMessages(t *testing.T) {
+func TestMigrationFromV1_0UpgradesSchemaAndPreservesData(t *testing.T) {
 	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-	defer db.Disconnect()
+	_ = os.Remove(testDbPath)
+	defer func() { _ = os.Remove(testDbPath) }()
 
-	var message1 = "test message 1"
-	var message2 = "test message 2"
-
-	var messageToken1 = "321"
-	var messageToken2 = "123"
+	// seed a v1.0 database by hand, complete with the buggy duplicate index
+	raw, err := sql.Open("sqlite3", testDbPath)
+	assert.Nil(err)
 
-	err := db.SaveMessage(messageToken1, 100, message1)
+	_, err = raw.Exec("CREATE TABLE global_vars(name TEXT PRIMARY KEY, integer_value INTEGER, string_value TEXT)")
+	assert.Nil(err)
+	_, err = raw.Exec("CREATE TABLE users(id INTEGER NOT NULL PRIMARY KEY, token TEXT NOT NULL, retention_limit_minutes INTEGER NOT NULL, max_size_bytes INTEGER NOT NULL, message_creation_limit_minutes INTEGER NOT NULL, last_message_creation_timestamp INTEGER)")
+	assert.Nil(err)
+	_, err = raw.Exec("CREATE TABLE messages(id INTEGER NOT NULL PRIMARY KEY, message_token TEXT NOT NULL, expire_timestamp INTEGER NOT NULL, data TEXT NOT NULL)")
+	assert.Nil(err)
+	_, err = raw.Exec("CREATE INDEX token_index ON users(token)")
+	assert.Nil(err)
+	_, err = raw.Exec("INSERT INTO global_vars (name, string_value) VALUES ('version', '1.0')")
 	assert.Nil(err)
-	err = db.SaveMessage(messageToken2, 200, message2)
+	_, err = raw.Exec("INSERT INTO users (token, retention_limit_minutes, max_size_bytes, message_creation_limit_minutes) VALUES ('321', 1, 2, 3)")
 	assert.Nil(err)
+	_, err = raw.Exec("INSERT INTO messages (message_token, expire_timestamp, data) VALUES ('msg-token', 100, 'hello')")
+	assert.Nil(err)
+	assert.Nil(raw.Close())
 
-	db.ClearExpiredMessages(160)
+	store, err := connectSqliteStore(testDbPath, DefaultConnectOptions)
+	assert.Nil(err)
+	defer store.Disconnect()
 
-	{
-		message, _ := db.TryConsumeMessage(messageToken1)
-		assert.Nil(message)
-	}
+	assert.Equal(latestVersion, store.GetDatabaseVersion())
+	assert.True(store.DoesUserExist("321"))
 
-	{
-		message, expireTimestamp := db.TryConsumeMessage(messageToken2)
-		assert.Equal(message2, *message)
-		assert.Equal(int64(200), expireTimestamp)
-	}
+	message, expireTimestamp, remainingReads := store.TryConsumeMessage("msg-token")
+	assert.Equal("hello", *message)
+	assert.Equal(int64(100), expireTimestamp)
+	assert.Equal(0, remainingReads)
+
+	rows, err := store.db.Query("SELECT name FROM sqlite_master WHERE type='index' AND name='message_token_index'")
+	assert.Nil(err)
+	assert.True(rows.Next())
+	assert.Nil(rows.Close())
 }
 
 func TestUserLastMessageCreationTime(t *testing.T) {
-	assert := require.New(t)
-	db := createDbAndConnect(t)
-	defer clearDb()
-	if db == nil {
-		t.Fail()
-		return
-	}
-	defer db.Disconnect()
-
-	token := "123"
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		token := "123"
+
+		store.SetUserLimits(token, 1, 2, 3, 0, 0)
+
+		{
+			lastTime := store.GetUserLastMessageCreationTime(token)
+			assert.Equal(int64(0), lastTime)
+		}
+
+		{
+			store.SetUserLastMessageCreationTime(token, 100)
+			lastTime := store.GetUserLastMessageCreationTime(token)
+			assert.Equal(int64(100), lastTime)
+		}
+
+		{
+			store.SetUserLastMessageCreationTime(token, 200)
+			lastTime := store.GetUserLastMessageCreationTime(token)
+			assert.Equal(int64(200), lastTime)
+		}
+	})
+}
 
-	db.SetUserLimits(token, 1, 2, 3)
+func TestSaveAndConsumeAttachment(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		ownerToken := "owner"
+		messageToken := "321"
+
+		err := store.SaveMessage(ownerToken, messageToken, 1000, "carrier message", 1)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata(messageToken, "image/png", "photo.png", 17, 1000)
+		assert.Nil(err)
+
+		found, mimeType, originalFilename, sizeBytes := store.GetAttachmentMetadata(messageToken)
+		assert.True(found)
+		assert.Equal("image/png", mimeType)
+		assert.Equal("photo.png", originalFilename)
+		assert.Equal(int64(17), sizeBytes)
+
+		// consuming the message's only read must take the attachment metadata with it
+		message, _, remainingReads := store.TryConsumeMessage(messageToken)
+		assert.NotNil(message)
+		assert.Equal(0, remainingReads)
+
+		found, _, _, _ = store.GetAttachmentMetadata(messageToken)
+		assert.False(found)
+	})
+}
 
-	{
-		lastTime := db.GetUserLastMessageCreationTime(token)
-		assert.Equal(int64(0), lastTime)
-	}
+func TestAttachmentByteQuota(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		ownerToken := "quota-owner"
+		assert.Equal(int64(0), store.AttachmentBytesUsedByUser(ownerToken, 500))
+
+		messageToken1 := "msg1"
+		err := store.SaveMessage(ownerToken, messageToken1, 1000, "first", 1)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata(messageToken1, "text/plain", "first.txt", 10, 1000)
+		assert.Nil(err)
+
+		assert.Equal(int64(10), store.AttachmentBytesUsedByUser(ownerToken, 500))
+
+		messageToken2 := "msg2"
+		err = store.SaveMessage(ownerToken, messageToken2, 2000, "second", 1)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata(messageToken2, "text/plain", "second.txt", 15, 2000)
+		assert.Nil(err)
+
+		// usage is attributed per owner, across every attachment they still have
+		assert.Equal(int64(25), store.AttachmentBytesUsedByUser(ownerToken, 500))
+
+		// an attachment that has already expired at nowTs no longer counts
+		// towards the quota, the same way ClearExpiredAttachments would free it
+		assert.Equal(int64(15), store.AttachmentBytesUsedByUser(ownerToken, 1500))
+
+		messageToken3 := "msg3"
+		err = store.SaveMessage(ownerToken, messageToken3, 0, "third", 1)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata(messageToken3, "text/plain", "third.txt", 5, 0)
+		assert.Nil(err)
+
+		// expire_timestamp=0 means "never expires", same as everywhere else
+		// that column is checked -- it must keep counting towards the quota
+		// no matter how far in the future nowTs is, not drop out of it
+		assert.Equal(int64(20), store.AttachmentBytesUsedByUser(ownerToken, 1500))
+	})
+}
 
-	{
-		db.SetUserLastMessageCreationTime(token, 100)
-		lastTime := db.GetUserLastMessageCreationTime(token)
-		assert.Equal(int64(100), lastTime)
-	}
+func TestClearExpiredAttachmentsFreesQuota(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		ownerToken := "expiring-owner"
+		messageToken := "msg"
+		err := store.SaveMessage(ownerToken, messageToken, 100, "carrier", 1)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata(messageToken, "text/plain", "notes.txt", 20, 100)
+		assert.Nil(err)
+
+		assert.Equal(int64(20), store.AttachmentBytesUsedByUser(ownerToken, 50))
+
+		expiredTokens := store.ClearExpiredAttachments(150)
+		assert.Equal([]string{messageToken}, expiredTokens)
+
+		assert.Equal(int64(0), store.AttachmentBytesUsedByUser(ownerToken, 50))
+		found, _, _, _ := store.GetAttachmentMetadata(messageToken)
+		assert.False(found)
+	})
+}
 
-	{
-		db.SetUserLastMessageCreationTime(token, 200)
-		lastTime := db.GetUserLastMessageCreationTime(token)
-		assert.Equal(int64(200), lastTime)
-	}
+func TestMetricsGaugeSources(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, b backend) {
+		assert := require.New(t)
+		store := b.createAndConnect(t)
+		defer b.clear()
+		if store == nil {
+			t.Fail()
+			return
+		}
+		defer store.Disconnect()
+
+		assert.Equal(0, store.CountMessages())
+		assert.Equal(0, store.CountUsers())
+		assert.Equal(int64(0), store.TotalAttachmentBytes(500))
+
+		store.SetUserLimits("user1", 1, 2, 3, 0, 0)
+		store.SetUserLimits("user2", 1, 2, 3, 0, 0)
+		assert.Equal(2, store.CountUsers())
+
+		err := store.SaveMessage("user1", "msg1", 1000, "hello", 1)
+		assert.Nil(err)
+		err = store.SaveMessage("user1", "msg2", 1000, "world", 1)
+		assert.Nil(err)
+		assert.Equal(2, store.CountMessages())
+
+		err = store.SaveAttachmentMetadata("msg1", "text/plain", "a.txt", 10, 1000)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata("msg2", "text/plain", "b.txt", 15, 1000)
+		assert.Nil(err)
+		assert.Equal(int64(25), store.TotalAttachmentBytes(500))
+
+		// an attachment expired as of nowTs is excluded, the same as AttachmentBytesUsedByUser
+		assert.Equal(int64(0), store.TotalAttachmentBytes(1500))
+
+		err = store.SaveMessage("user1", "msg3", 0, "!", 1)
+		assert.Nil(err)
+		err = store.SaveAttachmentMetadata("msg3", "text/plain", "c.txt", 7, 0)
+		assert.Nil(err)
+
+		// expire_timestamp=0 never expires, so it must never drop out of the gauge
+		assert.Equal(int64(7), store.TotalAttachmentBytes(1500))
+	})
 }
@@ -0,0 +1,126 @@
+// Package migrations holds the ordered schema upgrade steps for the SQLite
+// store. Each Migration moves the schema from one version to the next;
+// Path chains them together to get a database from whatever version it was
+// left at up to the latest one.
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Migration upgrades the schema from From to To.
+type Migration struct {
+	From string
+	To   string
+	Up   func(tx *sql.Tx) error
+}
+
+// All is the ordered list of every migration shipped so far.
+var All = []Migration{
+	{
+		From: "1.0",
+		To:   "1.1",
+		Up: func(tx *sql.Tx) error {
+			// the original index was named token_index on both tables, and the
+			// one "on messages" referenced a message(token) column that never
+			// existed, so it silently failed to index message lookups at all
+			if _, err := tx.Exec("DROP INDEX IF EXISTS token_index"); err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec("CREATE INDEX IF NOT EXISTS user_token_index ON users(token)"); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec("CREATE INDEX IF NOT EXISTS message_token_index ON messages(message_token)")
+			return err
+		},
+	},
+	{
+		From: "1.1",
+		To:   "1.2",
+		Up: func(tx *sql.Tx) error {
+			// multi-read shares: every existing message was good for exactly
+			// one read, so default the new counter to 1
+			if _, err := tx.Exec("ALTER TABLE messages ADD COLUMN remaining_reads INTEGER NOT NULL DEFAULT 1"); err != nil {
+				return err
+			}
+
+			// 0 means "no limit", matching the convention of the other *_limit columns
+			_, err := tx.Exec("ALTER TABLE users ADD COLUMN max_reads_limit INTEGER NOT NULL DEFAULT 0")
+			return err
+		},
+	},
+	{
+		From: "1.2",
+		To:   "1.3",
+		Up: func(tx *sql.Tx) error {
+			// owner_token lets us attribute attachments (and their byte
+			// quota) back to the user who created the message
+			if _, err := tx.Exec("ALTER TABLE messages ADD COLUMN owner_token TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+
+			if _, err := tx.Exec("ALTER TABLE users ADD COLUMN max_attachment_bytes INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec("CREATE TABLE IF NOT EXISTS" +
+				" attachments(id INTEGER NOT NULL PRIMARY KEY" +
+				",message_token TEXT NOT NULL" +
+				",mime_type TEXT NOT NULL" +
+				",size_bytes INTEGER NOT NULL" +
+				",blob BLOB NOT NULL" +
+				",expire_timestamp INTEGER NOT NULL" +
+				")")
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("CREATE INDEX IF NOT EXISTS attachment_message_token_index ON attachments(message_token)")
+			return err
+		},
+	},
+	{
+		From: "1.3",
+		To:   "1.4",
+		Up: func(tx *sql.Tx) error {
+			// attachment bytes now live on disk under the configured cache
+			// dir, keyed by message token, so the database only needs to
+			// keep the metadata needed to serve and account for them
+			if _, err := tx.Exec("ALTER TABLE attachments ADD COLUMN original_filename TEXT NOT NULL DEFAULT ''"); err != nil {
+				return err
+			}
+
+			_, err := tx.Exec("ALTER TABLE attachments DROP COLUMN blob")
+			return err
+		},
+	},
+}
+
+// Path returns the ordered list of migrations to apply to get from the
+// given version to target, or an error if no such chain is known.
+func Path(from string, target string) ([]Migration, error) {
+	if from == target {
+		return nil, nil
+	}
+
+	byFrom := make(map[string]Migration, len(All))
+	for _, m := range All {
+		byFrom[m.From] = m
+	}
+
+	var path []Migration
+	current := from
+	for current != target {
+		m, ok := byFrom[current]
+		if !ok {
+			return nil, fmt.Errorf("no migration path from version '%s' to '%s'", from, target)
+		}
+		path = append(path, m)
+		current = m.To
+	}
+
+	return path, nil
+}
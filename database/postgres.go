@@ -0,0 +1,374 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/lib/pq"
+	"log"
+	"sync"
+)
+
+// PostgresDb is the Postgres-backed Store implementation.
+type PostgresDb struct {
+	db    *sql.DB
+	mutex sync.Mutex
+}
+
+func connectPostgresStore(source string, opts ConnectOptions) (database *PostgresDb, err error) {
+	database = &PostgresDb{}
+
+	// a networked Postgres instance may not be reachable yet (e.g. it's
+	// still starting up in a neighboring container), so retry before
+	// giving up
+	err = withRetry(opts, func() error {
+		db, openErr := sql.Open("postgres", source)
+		if openErr != nil {
+			return openErr
+		}
+
+		if pingErr := db.Ping(); pingErr != nil {
+			_ = db.Close()
+			return pingErr
+		}
+
+		database.db = db
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	isNewDatabase := !database.tableExists("global_vars")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" global_vars(name TEXT PRIMARY KEY" +
+		",integer_value BIGINT" +
+		",string_value TEXT" +
+		")")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" users(id BIGSERIAL PRIMARY KEY" +
+		",token TEXT NOT NULL" +
+		",retention_limit_minutes INTEGER NOT NULL" +
+		",max_size_bytes INTEGER NOT NULL" +
+		",message_creation_limit_minutes INTEGER NOT NULL" +
+		",last_message_creation_timestamp BIGINT" +
+		",max_reads_limit INTEGER NOT NULL DEFAULT 0" +
+		",max_attachment_bytes BIGINT NOT NULL DEFAULT 0" +
+		")")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" messages(id BIGSERIAL PRIMARY KEY" +
+		",message_token TEXT NOT NULL" +
+		",expire_timestamp BIGINT NOT NULL" +
+		",data TEXT NOT NULL" +
+		",remaining_reads INTEGER NOT NULL DEFAULT 1" +
+		",owner_token TEXT NOT NULL DEFAULT ''" +
+		")")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" attachments(id BIGSERIAL PRIMARY KEY" +
+		",message_token TEXT NOT NULL" +
+		",mime_type TEXT NOT NULL" +
+		",original_filename TEXT NOT NULL DEFAULT ''" +
+		",size_bytes BIGINT NOT NULL" +
+		",expire_timestamp BIGINT NOT NULL" +
+		")")
+
+	database.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS" +
+		" user_token_index ON users(token)")
+
+	database.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS" +
+		" message_token_index ON messages(message_token)")
+
+	database.db.Exec("CREATE INDEX IF NOT EXISTS" +
+		" attachment_message_token_index ON attachments(message_token)")
+
+	if isNewDatabase {
+		// every table above was just created with the latest schema, so
+		// stamp it directly instead of leaving the version row unwritten
+		database.SetDatabaseVersion(latestVersion)
+	}
+
+	return
+}
+
+// tableExists reports whether a table with the given name already exists in
+// the database, so connectPostgresStore can tell a brand new database apart
+// from an existing one.
+func (database *PostgresDb) tableExists(name string) bool {
+	var exists bool
+	if err := database.db.QueryRow("SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_name=$1)", name).Scan(&exists); err != nil {
+		return false
+	}
+
+	return exists
+}
+
+func (database *PostgresDb) IsConnectionOpened() bool {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	return database.db != nil && database.db.Ping() == nil
+}
+
+func (database *PostgresDb) Disconnect() {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	if database.db != nil {
+		if err := database.db.Close(); err != nil {
+			log.Println("Error while closing postgres connection: ", err)
+		}
+		database.db = nil
+	}
+}
+
+func (database *PostgresDb) Ping(ctx context.Context) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	if database.db == nil {
+		return fmt.Errorf("database connection is not opened")
+	}
+
+	return database.db.PingContext(ctx)
+}
+
+func (database *PostgresDb) GetDatabaseVersion() (version string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT string_value FROM global_vars WHERE name='version'")
+	if err := row.Scan(&version); err != nil {
+		// no row means the version was never stamped; return "" so the
+		// caller can tell that apart from an actual version
+		return ""
+	}
+
+	return
+}
+
+func (database *PostgresDb) SetDatabaseVersion(version string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	database.db.Exec("DELETE FROM global_vars WHERE name='version'")
+	database.db.Exec("INSERT INTO global_vars (name, string_value) VALUES ('version', $1)", version)
+}
+
+func (database *PostgresDb) SetUserLimits(token string, retentionLimitMinutes int, maxSizeBytes int, messageCreationLimitMinutes int, maxReadsLimit int, maxAttachmentBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	database.db.Exec("INSERT INTO users (token, retention_limit_minutes, max_size_bytes, message_creation_limit_minutes, max_reads_limit, max_attachment_bytes) VALUES ($1, $2, $3, $4, $5, $6)"+
+		" ON CONFLICT (token) DO UPDATE SET retention_limit_minutes=$2, max_size_bytes=$3, message_creation_limit_minutes=$4, max_reads_limit=$5, max_attachment_bytes=$6",
+		token, retentionLimitMinutes, maxSizeBytes, messageCreationLimitMinutes, maxReadsLimit, maxAttachmentBytes)
+}
+
+func (database *PostgresDb) GetUserLimits(token string) (isFound bool, retentionLimitMinutes int, maxSizeBytes int, messageCreationLimitMinutes int, maxReadsLimit int, maxAttachmentBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT retention_limit_minutes, max_size_bytes, message_creation_limit_minutes, max_reads_limit, max_attachment_bytes FROM users WHERE token=$1", token)
+	if err := row.Scan(&retentionLimitMinutes, &maxSizeBytes, &messageCreationLimitMinutes, &maxReadsLimit, &maxAttachmentBytes); err != nil {
+		return
+	}
+
+	isFound = true
+	return
+}
+
+func (database *PostgresDb) DoesUserExist(token string) bool {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	var id int64
+	row := database.db.QueryRow("SELECT id FROM users WHERE token=$1", token)
+	return row.Scan(&id) == nil
+}
+
+func (database *PostgresDb) RemoveUserByToken(token string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	database.db.Exec("DELETE FROM users WHERE token=$1", token)
+}
+
+func (database *PostgresDb) SetUserLastMessageCreationTime(token string, timestamp int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	database.db.Exec("UPDATE users SET last_message_creation_timestamp=$1 WHERE token=$2", timestamp, token)
+}
+
+func (database *PostgresDb) GetUserLastMessageCreationTime(token string) (timestamp int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT last_message_creation_timestamp FROM users WHERE token=$1 AND last_message_creation_timestamp IS NOT NULL", token)
+	if err := row.Scan(&timestamp); err != nil {
+		return 0
+	}
+
+	return
+}
+
+func (database *PostgresDb) SaveMessage(ownerToken string, messageToken string, expireTimestamp int64, data string, maxReads int) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	_, err := database.db.Exec("INSERT INTO messages (owner_token, message_token, expire_timestamp, data, remaining_reads) VALUES ($1, $2, $3, $4, $5)", ownerToken, messageToken, expireTimestamp, data, maxReads)
+	if err != nil {
+		return fmt.Errorf("message with message_token '%s' already exists", messageToken)
+	}
+
+	return nil
+}
+
+func (database *PostgresDb) TryConsumeMessage(messageToken string) (data *string, expireTimestamp int64, remainingReads int) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	// a single statement UPDATE ... RETURNING makes claiming a read atomic,
+	// no extra locking needed; the row is only deleted once it's exhausted
+	row := database.db.QueryRow("UPDATE messages SET remaining_reads = remaining_reads - 1"+
+		" WHERE message_token=$1 AND remaining_reads > 0 RETURNING id, data, expire_timestamp, remaining_reads", messageToken)
+
+	var id int64
+	var value string
+	if err := row.Scan(&id, &value, &expireTimestamp, &remainingReads); err != nil {
+		return nil, 0, 0
+	}
+
+	if remainingReads <= 0 {
+		// consume the message and its attachment together so a reader can
+		// never observe one gone and the other still around
+		tx, err := database.db.Begin()
+		if err != nil {
+			return &value, expireTimestamp, remainingReads
+		}
+
+		tx.Exec("DELETE FROM messages WHERE id=$1", id)
+		tx.Exec("DELETE FROM attachments WHERE message_token=$1", messageToken)
+		tx.Commit()
+	}
+
+	return &value, expireTimestamp, remainingReads
+}
+
+func (database *PostgresDb) ClearExpiredMessages(now int64) (expiredTokens []string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	rows, err := database.db.Query("DELETE FROM messages WHERE expire_timestamp != 0 AND expire_timestamp < $1 RETURNING message_token", now)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return expiredTokens
+		}
+		expiredTokens = append(expiredTokens, token)
+	}
+
+	return
+}
+
+func (database *PostgresDb) SaveAttachmentMetadata(messageToken string, mimeType string, originalFilename string, sizeBytes int64, expireTimestamp int64) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	_, err := database.db.Exec("INSERT INTO attachments (message_token, mime_type, original_filename, size_bytes, expire_timestamp) VALUES ($1, $2, $3, $4, $5)",
+		messageToken, mimeType, originalFilename, sizeBytes, expireTimestamp)
+	if err != nil {
+		return fmt.Errorf("failed to save attachment metadata for message_token '%s': %w", messageToken, err)
+	}
+
+	return nil
+}
+
+func (database *PostgresDb) GetAttachmentMetadata(messageToken string) (found bool, mimeType string, originalFilename string, sizeBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT mime_type, original_filename, size_bytes FROM attachments WHERE message_token=$1", messageToken)
+	if err := row.Scan(&mimeType, &originalFilename, &sizeBytes); err != nil {
+		return false, "", "", 0
+	}
+
+	return true, mimeType, originalFilename, sizeBytes
+}
+
+func (database *PostgresDb) DeleteAttachmentMetadata(messageToken string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	database.db.Exec("DELETE FROM attachments WHERE message_token=$1", messageToken)
+}
+
+func (database *PostgresDb) ClearExpiredAttachments(now int64) (expiredTokens []string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	rows, err := database.db.Query("DELETE FROM attachments WHERE expire_timestamp != 0 AND expire_timestamp < $1 RETURNING message_token", now)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			return expiredTokens
+		}
+		expiredTokens = append(expiredTokens, token)
+	}
+
+	return
+}
+
+func (database *PostgresDb) AttachmentBytesUsedByUser(token string, nowTs int64) (totalBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT COALESCE(SUM(a.size_bytes), 0) FROM attachments a"+
+		" JOIN messages m ON a.message_token=m.message_token WHERE m.owner_token=$1 AND (a.expire_timestamp=0 OR a.expire_timestamp>=$2)", token, nowTs)
+	row.Scan(&totalBytes)
+
+	return totalBytes
+}
+
+func (database *PostgresDb) CountMessages() (count int) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT COUNT(*) FROM messages")
+	row.Scan(&count)
+
+	return count
+}
+
+func (database *PostgresDb) CountUsers() (count int) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT COUNT(*) FROM users")
+	row.Scan(&count)
+
+	return count
+}
+
+func (database *PostgresDb) TotalAttachmentBytes(nowTs int64) (totalBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	row := database.db.QueryRow("SELECT COALESCE(SUM(size_bytes), 0) FROM attachments WHERE expire_timestamp=0 OR expire_timestamp>=$1", nowTs)
+	row.Scan(&totalBytes)
+
+	return totalBytes
+}
@@ -0,0 +1,790 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/gameraccoon/one-time-share/database/migrations"
+	dbBase "github.com/gameraccoon/telegram-bot-skeleton/database"
+	_ "github.com/mattn/go-sqlite3"
+	"log"
+	"sync"
+)
+
+// OneTimeShareDb is the SQLite-backed Store implementation.
+type OneTimeShareDb struct {
+	db    dbBase.Database
+	mutex sync.Mutex
+	stmts *stmtCache
+}
+
+// stmtCache lazily prepares and reuses *sql.Stmt instances keyed by query
+// text, so repeated calls don't pay to re-parse and re-plan the same SQL.
+type stmtCache struct {
+	mutex sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func newStmtCache() *stmtCache {
+	return &stmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+func (c *stmtCache) get(db dbBase.Database, query string) (*sql.Stmt, error) {
+	c.mutex.RLock()
+	stmt, ok := c.stmts[query]
+	c.mutex.RUnlock()
+	if ok {
+		return stmt, nil
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if stmt, ok := c.stmts[query]; ok {
+		return stmt, nil
+	}
+
+	stmt, err := db.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+func init() {
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+}
+
+func connectSqliteStore(path string, opts ConnectOptions) (database *OneTimeShareDb, err error) {
+	database = &OneTimeShareDb{stmts: newStmtCache()}
+
+	// the file may live on a slow-mounted volume, or this may be the first
+	// of several instances racing to create it, so don't give up on the
+	// first failure
+	err = withRetry(opts, func() error {
+		if connectErr := database.db.Connect(path); connectErr != nil {
+			return connectErr
+		}
+
+		if !database.db.IsConnectionOpened() {
+			return fmt.Errorf("connection to '%s' opened but is not usable", path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	isNewDatabase := !database.tableExists("global_vars")
+
+	// an existing database is migrated before the CREATE TABLE statements
+	// below run, since those create any missing table (e.g. attachments)
+	// with the latest schema, which an older migration would then try to
+	// ALTER again
+	if !isNewDatabase {
+		if err = database.runMigrations(); err != nil {
+			return nil, err
+		}
+	}
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" global_vars(name TEXT PRIMARY KEY" +
+		",integer_value INTEGER" +
+		",string_value TEXT" +
+		")")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" users(id INTEGER NOT NULL PRIMARY KEY" +
+		",token TEXT NOT NULL" +
+		",retention_limit_minutes INTEGER NOT NULL" +
+		",max_size_bytes INTEGER NOT NULL" +
+		",message_creation_limit_minutes INTEGER NOT NULL" +
+		",last_message_creation_timestamp INTEGER" +
+		",max_reads_limit INTEGER NOT NULL DEFAULT 0" +
+		",max_attachment_bytes INTEGER NOT NULL DEFAULT 0" +
+		")")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" messages(id INTEGER NOT NULL PRIMARY KEY" +
+		",message_token TEXT NOT NULL" +
+		",expire_timestamp INTEGER NOT NULL" +
+		",data TEXT NOT NULL" +
+		",remaining_reads INTEGER NOT NULL DEFAULT 1" +
+		",owner_token TEXT NOT NULL DEFAULT ''" +
+		")")
+
+	database.db.Exec("CREATE TABLE IF NOT EXISTS" +
+		" attachments(id INTEGER NOT NULL PRIMARY KEY" +
+		",message_token TEXT NOT NULL" +
+		",mime_type TEXT NOT NULL" +
+		",original_filename TEXT NOT NULL DEFAULT ''" +
+		",size_bytes INTEGER NOT NULL" +
+		",expire_timestamp INTEGER NOT NULL" +
+		")")
+
+	database.db.Exec("CREATE INDEX IF NOT EXISTS" +
+		" user_token_index ON users(token)")
+
+	database.db.Exec("CREATE INDEX IF NOT EXISTS" +
+		" message_token_index ON messages(message_token)")
+
+	database.db.Exec("CREATE INDEX IF NOT EXISTS" +
+		" attachment_message_token_index ON attachments(message_token)")
+
+	if isNewDatabase {
+		// every table above was just created with the latest schema, so
+		// there's nothing to migrate -- record that directly instead of
+		// running runMigrations, which would try to ALTER TABLE columns
+		// that already exist
+		database.SetDatabaseVersion(latestVersion)
+	}
+
+	return
+}
+
+// tableExists reports whether a table with the given name already exists in
+// the database, so callers can tell a brand new database (created with the
+// CREATE TABLE IF NOT EXISTS statements above) apart from an existing one.
+func (database *OneTimeShareDb) tableExists(name string) bool {
+	stmt, err := database.stmts.get(database.db, "SELECT name FROM sqlite_master WHERE type='table' AND name=?")
+	if err != nil {
+		logQueryError(err)
+		return false
+	}
+
+	rows, err := stmt.Query(name)
+	if err != nil {
+		logQueryError(err)
+		return false
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	return rows.Next()
+}
+
+// runMigrations walks the database from whatever version it was left at up
+// to latestVersion, applying every step inside a single transaction.
+func (database *OneTimeShareDb) runMigrations() error {
+	currentVersion := database.GetDatabaseVersion()
+	if currentVersion == "" {
+		// an existing database with no version row predates version
+		// tracking entirely, so its schema is whatever migrations knows as
+		// the very first version
+		currentVersion = "1.0"
+	}
+
+	if currentVersion == latestVersion {
+		return nil
+	}
+
+	path, err := migrations.Path(currentVersion, latestVersion)
+	if err != nil {
+		return err
+	}
+
+	tx, err := database.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range path {
+		if err := m.Up(tx); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+
+		if _, err := tx.Exec("DELETE FROM global_vars WHERE name='version'"); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO global_vars (name, string_value) VALUES ('version', ?)", m.To); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (database *OneTimeShareDb) IsConnectionOpened() bool {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	return database.db.IsConnectionOpened()
+}
+
+func (database *OneTimeShareDb) Disconnect() {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	database.db.Disconnect()
+}
+
+func (database *OneTimeShareDb) Ping(ctx context.Context) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	if !database.db.IsConnectionOpened() {
+		return fmt.Errorf("database connection is not opened")
+	}
+
+	return nil
+}
+
+// logQueryError reports a failure from a query path without taking down the
+// whole process; a transient DB blip should surface as a failed request, not
+// a crashed server.
+func logQueryError(err error) {
+	log.Println("Database query error: ", err)
+}
+
+func (database *OneTimeShareDb) GetDatabaseVersion() (version string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT string_value FROM global_vars WHERE name='version'")
+	if err != nil {
+		logQueryError(err)
+		return ""
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		logQueryError(err)
+		return ""
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			logQueryError(err)
+			return ""
+		}
+	}
+	// else: no row means the version was never stamped; return "" so the
+	// caller can tell that apart from an actual version
+
+	return
+}
+
+func (database *OneTimeShareDb) SetDatabaseVersion(version string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	deleteStmt, err := database.stmts.get(database.db, "DELETE FROM global_vars WHERE name='version'")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	if _, err := deleteStmt.Exec(); err != nil {
+		logQueryError(err)
+		return
+	}
+
+	insertStmt, err := database.stmts.get(database.db, "INSERT INTO global_vars (name, string_value) VALUES ('version', ?)")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	if _, err := insertStmt.Exec(version); err != nil {
+		logQueryError(err)
+	}
+}
+
+func (database *OneTimeShareDb) SetUserLimits(token string, retentionLimitMinutes int, maxSizeBytes int, messageCreationLimitMinutes int, maxReadsLimit int, maxAttachmentBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "INSERT OR REPLACE INTO users (token, retention_limit_minutes, max_size_bytes, message_creation_limit_minutes, max_reads_limit, max_attachment_bytes) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	if _, err := stmt.Exec(token, retentionLimitMinutes, maxSizeBytes, messageCreationLimitMinutes, maxReadsLimit, maxAttachmentBytes); err != nil {
+		logQueryError(err)
+	}
+}
+
+func (database *OneTimeShareDb) GetUserLimits(token string) (isFound bool, retentionLimitMinutes int, maxSizeBytes int, messageCreationLimitMinutes int, maxReadsLimit int, maxAttachmentBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT retention_limit_minutes, max_size_bytes, message_creation_limit_minutes, max_reads_limit, max_attachment_bytes FROM users WHERE token=?")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+
+	rows, err := stmt.Query(token)
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&retentionLimitMinutes, &maxSizeBytes, &messageCreationLimitMinutes, &maxReadsLimit, &maxAttachmentBytes); err != nil {
+			logQueryError(err)
+			return false, 0, 0, 0, 0, 0
+		}
+		isFound = true
+	} else if err := rows.Err(); err != nil {
+		logQueryError(err)
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) DoesUserExist(token string) bool {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT id FROM users WHERE token=?")
+	if err != nil {
+		logQueryError(err)
+		return false
+	}
+
+	rows, err := stmt.Query(token)
+	if err != nil {
+		logQueryError(err)
+		return false
+	}
+
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	return rows.Next()
+}
+
+func (database *OneTimeShareDb) RemoveUserByToken(token string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "DELETE FROM users WHERE token=?")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	if _, err := stmt.Exec(token); err != nil {
+		logQueryError(err)
+	}
+}
+
+func (database *OneTimeShareDb) SetUserLastMessageCreationTime(token string, timestamp int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "UPDATE users SET last_message_creation_timestamp=? WHERE token=?")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	if _, err := stmt.Exec(timestamp, token); err != nil {
+		logQueryError(err)
+	}
+}
+
+func (database *OneTimeShareDb) GetUserLastMessageCreationTime(token string) (timestamp int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT last_message_creation_timestamp FROM users WHERE token=? AND last_message_creation_timestamp IS NOT NULL")
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+
+	rows, err := stmt.Query(token)
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&timestamp); err != nil {
+			logQueryError(err)
+			return 0
+		}
+	} else {
+		return 0
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) SaveMessage(ownerToken string, messageToken string, expireTimestamp int64, data string, maxReads int) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	existsStmt, err := database.stmts.get(database.db, "SELECT id FROM messages WHERE message_token=?")
+	if err != nil {
+		return err
+	}
+
+	// check if we have any messages with this message_token
+	rows, err := existsStmt.Query(messageToken)
+	if err != nil {
+		return err
+	}
+
+	exists := rows.Next()
+	if err := rows.Close(); err != nil {
+		return err
+	}
+
+	if exists {
+		// we already have a message with this message_token
+		return fmt.Errorf("message with message_token '%s' already exists", messageToken)
+	}
+
+	insertStmt, err := database.stmts.get(database.db, "INSERT INTO messages (message_token, expire_timestamp, data, remaining_reads, owner_token) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	_, err = insertStmt.Exec(messageToken, expireTimestamp, data, maxReads, ownerToken)
+	return err
+}
+
+func (database *OneTimeShareDb) TryConsumeMessage(messageToken string) (data *string, expireTimestamp int64, remainingReads int) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	// atomically claims one read; SQLite 3.35+ RETURNING lets us do this
+	// without a separate SELECT-then-DELETE race
+	consumeStmt, err := database.stmts.get(database.db, "UPDATE messages SET remaining_reads = remaining_reads - 1"+
+		" WHERE message_token=? AND remaining_reads > 0 RETURNING id, expire_timestamp, data, remaining_reads")
+	if err != nil {
+		logQueryError(err)
+		return nil, 0, 0
+	}
+
+	rows, err := consumeStmt.Query(messageToken)
+	if err != nil {
+		logQueryError(err)
+		return nil, 0, 0
+	}
+
+	id := -1
+	found := false
+	if rows.Next() {
+		if err := rows.Scan(&id, &expireTimestamp, &data, &remainingReads); err != nil {
+			logQueryError(err)
+			_ = rows.Close()
+			return nil, 0, 0
+		}
+		found = true
+	}
+
+	if err := rows.Close(); err != nil {
+		logQueryError(err)
+		return nil, 0, 0
+	}
+
+	if !found {
+		return nil, 0, 0
+	}
+
+	if remainingReads <= 0 {
+		// the message and its attachment must disappear together, so a
+		// reader can never observe one without the other
+		tx, err := database.db.Begin()
+		if err != nil {
+			logQueryError(err)
+			return data, expireTimestamp, remainingReads
+		}
+
+		if _, err := tx.Exec("DELETE FROM messages WHERE id=?", id); err != nil {
+			_ = tx.Rollback()
+			logQueryError(err)
+			return data, expireTimestamp, remainingReads
+		}
+		if _, err := tx.Exec("DELETE FROM attachments WHERE message_token=?", messageToken); err != nil {
+			_ = tx.Rollback()
+			logQueryError(err)
+			return data, expireTimestamp, remainingReads
+		}
+
+		if err := tx.Commit(); err != nil {
+			logQueryError(err)
+		}
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) ClearExpiredMessages(now int64) (expiredTokens []string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "DELETE FROM messages WHERE expire_timestamp != 0 AND expire_timestamp < ? RETURNING message_token")
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+
+	rows, err := stmt.Query(now)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			logQueryError(err)
+			return expiredTokens
+		}
+		expiredTokens = append(expiredTokens, token)
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) SaveAttachmentMetadata(messageToken string, mimeType string, originalFilename string, sizeBytes int64, expireTimestamp int64) error {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "INSERT INTO attachments (message_token, mime_type, original_filename, size_bytes, expire_timestamp) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+
+	_, err = stmt.Exec(messageToken, mimeType, originalFilename, sizeBytes, expireTimestamp)
+	return err
+}
+
+func (database *OneTimeShareDb) GetAttachmentMetadata(messageToken string) (found bool, mimeType string, originalFilename string, sizeBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT mime_type, original_filename, size_bytes FROM attachments WHERE message_token=?")
+	if err != nil {
+		logQueryError(err)
+		return false, "", "", 0
+	}
+
+	rows, err := stmt.Query(messageToken)
+	if err != nil {
+		logQueryError(err)
+		return false, "", "", 0
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if !rows.Next() {
+		return false, "", "", 0
+	}
+
+	if err := rows.Scan(&mimeType, &originalFilename, &sizeBytes); err != nil {
+		logQueryError(err)
+		return false, "", "", 0
+	}
+
+	return true, mimeType, originalFilename, sizeBytes
+}
+
+func (database *OneTimeShareDb) DeleteAttachmentMetadata(messageToken string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "DELETE FROM attachments WHERE message_token=?")
+	if err != nil {
+		logQueryError(err)
+		return
+	}
+	if _, err := stmt.Exec(messageToken); err != nil {
+		logQueryError(err)
+	}
+}
+
+func (database *OneTimeShareDb) ClearExpiredAttachments(now int64) (expiredTokens []string) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "DELETE FROM attachments WHERE expire_timestamp != 0 AND expire_timestamp < ? RETURNING message_token")
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+
+	rows, err := stmt.Query(now)
+	if err != nil {
+		logQueryError(err)
+		return nil
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			logQueryError(err)
+			return expiredTokens
+		}
+		expiredTokens = append(expiredTokens, token)
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) AttachmentBytesUsedByUser(token string, nowTs int64) (totalBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT IFNULL(SUM(size_bytes),0) FROM attachments a"+
+		" JOIN messages m ON a.message_token=m.message_token WHERE m.owner_token=? AND (a.expire_timestamp=0 OR a.expire_timestamp>=?)")
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+
+	rows, err := stmt.Query(token, nowTs)
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&totalBytes); err != nil {
+			logQueryError(err)
+			return 0
+		}
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) CountMessages() (count int) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT COUNT(*) FROM messages")
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			logQueryError(err)
+			return 0
+		}
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) CountUsers() (count int) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT COUNT(*) FROM users")
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+
+	rows, err := stmt.Query()
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			logQueryError(err)
+			return 0
+		}
+	}
+
+	return
+}
+
+func (database *OneTimeShareDb) TotalAttachmentBytes(nowTs int64) (totalBytes int64) {
+	database.mutex.Lock()
+	defer database.mutex.Unlock()
+
+	stmt, err := database.stmts.get(database.db, "SELECT IFNULL(SUM(size_bytes),0) FROM attachments WHERE expire_timestamp=0 OR expire_timestamp>=?")
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+
+	rows, err := stmt.Query(nowTs)
+	if err != nil {
+		logQueryError(err)
+		return 0
+	}
+	defer func(rows *sql.Rows) {
+		if err := rows.Close(); err != nil {
+			logQueryError(err)
+		}
+	}(rows)
+
+	if rows.Next() {
+		if err := rows.Scan(&totalBytes); err != nil {
+			logQueryError(err)
+			return 0
+		}
+	}
+
+	return
+}
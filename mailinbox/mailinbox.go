@@ -0,0 +1,198 @@
+// Package mailinbox runs an embedded SMTP server that lets a user email a
+// message to their own user token (e.g. <user-token>@share.example.com) and
+// have it turned into a one-time-share URL, modeled on the way ntfy accepts
+// email-to-push via github.com/emersion/go-smtp. The package only parses
+// inbound mail; turning the result into a saved message (and replying with
+// the share URL) is left to the Handler the caller supplies, so this
+// package never needs to know about the database or the attachment cache.
+package mailinbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/smtp"
+	"strings"
+
+	gosmtp "github.com/emersion/go-smtp"
+)
+
+// Attachment is the first part of an inbound email that carries a filename,
+// if any.
+type Attachment struct {
+	Filename string
+	Reader   io.Reader
+}
+
+// Handler is invoked once per inbound email addressed to toLocalPart (the
+// part of the recipient address before the '@'). body is the plain-text
+// part of the message; attachment is non-nil if any part of the email
+// carried a filename. Returning an error rejects the message at the SMTP
+// level.
+type Handler func(fromAddr string, toLocalPart string, body string, attachment *Attachment) error
+
+// Config controls how the embedded SMTP server identifies itself and where
+// it listens.
+type Config struct {
+	// address the SMTP server listens on, e.g. ":2525"
+	ListenAddr string
+	// domain name announced in the server's greeting banner
+	Domain string
+}
+
+// Server wraps a go-smtp server configured with a backend that calls a
+// Handler for every message it receives.
+type Server struct {
+	smtpServer *gosmtp.Server
+}
+
+// NewServer builds a Server ready to ListenAndServe; it does not start
+// listening on its own.
+func NewServer(config Config, handle Handler) *Server {
+	s := gosmtp.NewServer(&backend{handle: handle})
+	s.Addr = config.ListenAddr
+	s.Domain = config.Domain
+	s.AllowInsecureAuth = true
+
+	return &Server{smtpServer: s}
+}
+
+// ListenAndServe starts accepting SMTP connections; it blocks until the
+// server is closed or a listener error occurs.
+func (s *Server) ListenAndServe() error {
+	return s.smtpServer.ListenAndServe()
+}
+
+// Close stops the server from accepting further connections.
+func (s *Server) Close() error {
+	return s.smtpServer.Close()
+}
+
+type backend struct {
+	handle Handler
+}
+
+func (b *backend) NewSession(_ *gosmtp.Conn) (gosmtp.Session, error) {
+	return &session{handle: b.handle}, nil
+}
+
+// session collects the state of one inbound email: who it's from, which
+// user token it's addressed to, and (once Data is called) its parsed body.
+type session struct {
+	handle Handler
+
+	fromAddr string
+	toLocal  string
+}
+
+func (s *session) Mail(from string, _ *gosmtp.MailOptions) error {
+	s.fromAddr = from
+	return nil
+}
+
+func (s *session) Rcpt(to string, _ *gosmtp.RcptOptions) error {
+	localPart, _, found := strings.Cut(to, "@")
+	if !found || localPart == "" {
+		return fmt.Errorf("recipient '%s' is not a valid address", to)
+	}
+
+	s.toLocal = localPart
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return fmt.Errorf("can't parse message: %w", err)
+	}
+
+	body, attachment, err := parseBody(msg)
+	if err != nil {
+		return err
+	}
+
+	return s.handle(s.fromAddr, s.toLocal, body, attachment)
+}
+
+func (s *session) Reset() {}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+// parseBody extracts the plain-text body (and, if present, the first part
+// with a filename as an attachment) from msg. Parts with neither a filename
+// nor a text/plain type are ignored. A non-multipart message is treated
+// entirely as the body.
+func parseBody(msg *mail.Message) (body string, attachment *Attachment, err error) {
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		data, readErr := io.ReadAll(msg.Body)
+		if readErr != nil {
+			return "", nil, fmt.Errorf("can't read message body: %w", readErr)
+		}
+
+		return strings.TrimSpace(string(data)), nil, nil
+	}
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, partErr := reader.NextPart()
+		if partErr == io.EOF {
+			break
+		}
+		if partErr != nil {
+			return "", nil, fmt.Errorf("can't read message part: %w", partErr)
+		}
+
+		filename := part.FileName()
+		data, readErr := io.ReadAll(part)
+		if readErr != nil {
+			return "", nil, fmt.Errorf("can't read message part: %w", readErr)
+		}
+
+		if filename == "" && body == "" && strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain") {
+			body = strings.TrimSpace(string(data))
+			continue
+		}
+
+		if filename != "" && attachment == nil {
+			attachment = &Attachment{Filename: filename, Reader: bytes.NewReader(data)}
+		}
+	}
+
+	return body, attachment, nil
+}
+
+// Mailer sends plain-text emails through an SMTP relay, used to reply to an
+// inbound message with its one-time-share URL.
+type Mailer struct {
+	relayAddr string
+	from      string
+	auth      smtp.Auth
+}
+
+// NewMailer builds a Mailer that delivers through relayAddr (host:port),
+// authenticating with user/pass if user is non-empty, and sends mail as
+// from.
+func NewMailer(relayAddr string, from string, user string, pass string) *Mailer {
+	var auth smtp.Auth
+	if user != "" {
+		host := relayAddr
+		if idx := strings.LastIndex(relayAddr, ":"); idx >= 0 {
+			host = relayAddr[:idx]
+		}
+		auth = smtp.PlainAuth("", user, pass, host)
+	}
+
+	return &Mailer{relayAddr: relayAddr, from: from, auth: auth}
+}
+
+// Send delivers a plain-text email to "to" with the given subject and body.
+func (m *Mailer) Send(to string, subject string, body string) error {
+	message := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.from, to, subject, body)
+	return smtp.SendMail(m.relayAddr, m.auth, m.from, []string{to}, []byte(message))
+}
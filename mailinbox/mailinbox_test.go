@@ -0,0 +1,72 @@
+package mailinbox
+
+import (
+	"io"
+	"net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBodyPlainMessage(t *testing.T) {
+	assert := require.New(t)
+
+	raw := "From: a@example.com\r\nTo: b@example.com\r\nSubject: hi\r\n\r\nhello there\r\n"
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	assert.Nil(err)
+
+	body, attachment, err := parseBody(msg)
+	assert.Nil(err)
+	assert.Equal("hello there", body)
+	assert.Nil(attachment)
+}
+
+func TestParseBodyMultipartWithAttachment(t *testing.T) {
+	assert := require.New(t)
+
+	raw := "From: a@example.com\r\n" +
+		"To: b@example.com\r\n" +
+		"Content-Type: multipart/mixed; boundary=XYZ\r\n" +
+		"\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"hello there\r\n" +
+		"--XYZ\r\n" +
+		"Content-Type: application/octet-stream\r\n" +
+		"Content-Disposition: attachment; filename=\"notes.txt\"\r\n" +
+		"\r\n" +
+		"file contents\r\n" +
+		"--XYZ--\r\n"
+
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	assert.Nil(err)
+
+	body, attachment, err := parseBody(msg)
+	assert.Nil(err)
+	assert.Equal("hello there", body)
+	assert.NotNil(attachment)
+	assert.Equal("notes.txt", attachment.Filename)
+
+	data, err := io.ReadAll(attachment.Reader)
+	assert.Nil(err)
+	assert.Equal("file contents", string(data))
+}
+
+func TestRcptRejectsAddressWithoutAt(t *testing.T) {
+	assert := require.New(t)
+
+	s := &session{}
+	err := s.Rcpt("not-an-address", nil)
+	assert.NotNil(err)
+}
+
+func TestRcptStoresLocalPart(t *testing.T) {
+	assert := require.New(t)
+
+	s := &session{}
+	err := s.Rcpt("user-token@share.example.com", nil)
+	assert.Nil(err)
+	assert.Equal("user-token", s.toLocal)
+}
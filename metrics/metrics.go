@@ -0,0 +1,142 @@
+// Package metrics exposes the server's internal counters, histograms and
+// gauges as a Prometheus registry, optionally served over HTTP. Handlers
+// call the increment/observe methods inline; the gauges are expected to be
+// refreshed periodically by a caller-owned sampler, since they reflect
+// database state rather than in-process events.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds every collector this server reports. All methods are safe
+// for concurrent use, same as the underlying prometheus collectors.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	messagesCreatedTotal     prometheus.Counter
+	messagesConsumedTotal    *prometheus.CounterVec
+	attachmentsUploadedTotal prometheus.Counter
+	saveRejectedTotal        *prometheus.CounterVec
+
+	requestDuration *prometheus.HistogramVec
+	messageSize     prometheus.Histogram
+
+	messagesStored         prometheus.Gauge
+	attachmentsStoredBytes prometheus.Gauge
+	usersTotal             prometheus.Gauge
+}
+
+// NewMetrics registers every collector on a fresh registry and returns a
+// Metrics ready to be incremented, observed and served.
+func NewMetrics() *Metrics {
+	registry := prometheus.NewRegistry()
+
+	m := &Metrics{
+		registry: registry,
+		messagesCreatedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "messages_created_total",
+			Help: "Total number of messages successfully saved.",
+		}),
+		messagesConsumedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "messages_consumed_total",
+			Help: "Total number of /consume requests, by result (ok or not_found).",
+		}, []string{"result"}),
+		attachmentsUploadedTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "attachments_uploaded_total",
+			Help: "Total number of attachments successfully saved.",
+		}),
+		saveRejectedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "save_rejected_total",
+			Help: "Total number of /save requests rejected, by reason.",
+		}, []string{"reason"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "request_duration_seconds",
+			Help: "Request handling latency in seconds, by handler.",
+		}, []string{"handler"}),
+		messageSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "message_size_bytes",
+			Help:    "Size in bytes of saved message bodies.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 8),
+		}),
+		messagesStored: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "messages_stored",
+			Help: "Number of messages currently stored.",
+		}),
+		attachmentsStoredBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "attachments_stored_bytes",
+			Help: "Total bytes of not-yet-expired attachments currently stored.",
+		}),
+		usersTotal: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "users_total",
+			Help: "Number of registered users.",
+		}),
+	}
+
+	registry.MustRegister(
+		m.messagesCreatedTotal,
+		m.messagesConsumedTotal,
+		m.attachmentsUploadedTotal,
+		m.saveRejectedTotal,
+		m.requestDuration,
+		m.messageSize,
+		m.messagesStored,
+		m.attachmentsStoredBytes,
+		m.usersTotal,
+	)
+
+	return m
+}
+
+// Handler returns an http.Handler serving this Metrics' registry in the
+// Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// MessageCreated records a successfully saved message of the given size.
+func (m *Metrics) MessageCreated(sizeBytes int) {
+	m.messagesCreatedTotal.Inc()
+	m.messageSize.Observe(float64(sizeBytes))
+}
+
+// MessageConsumed records a /consume request resolving to result, which
+// should be "ok" or "not_found".
+func (m *Metrics) MessageConsumed(result string) {
+	m.messagesConsumedTotal.WithLabelValues(result).Inc()
+}
+
+// AttachmentUploaded records a successfully saved attachment.
+func (m *Metrics) AttachmentUploaded() {
+	m.attachmentsUploadedTotal.Inc()
+}
+
+// SaveRejected records a /save request rejected for reason, e.g.
+// "rate_limit", "too_big", "bad_retention" or "unknown_user".
+func (m *Metrics) SaveRejected(reason string) {
+	m.saveRejectedTotal.WithLabelValues(reason).Inc()
+}
+
+// ObserveRequestDuration records how long handler took to serve a request.
+func (m *Metrics) ObserveRequestDuration(handler string, duration time.Duration) {
+	m.requestDuration.WithLabelValues(handler).Observe(duration.Seconds())
+}
+
+// SetMessagesStored sets the messages_stored gauge.
+func (m *Metrics) SetMessagesStored(count int) {
+	m.messagesStored.Set(float64(count))
+}
+
+// SetAttachmentsStoredBytes sets the attachments_stored_bytes gauge.
+func (m *Metrics) SetAttachmentsStoredBytes(sizeBytes int64) {
+	m.attachmentsStoredBytes.Set(float64(sizeBytes))
+}
+
+// SetUsersTotal sets the users_total gauge.
+func (m *Metrics) SetUsersTotal(count int) {
+	m.usersTotal.Set(float64(count))
+}
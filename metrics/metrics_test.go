@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageCreatedIncrementsCounterAndHistogram(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewMetrics()
+	m.MessageCreated(42)
+
+	assert.Equal(float64(1), testutil.ToFloat64(m.messagesCreatedTotal))
+	assert.Equal(uint64(1), testutil.CollectAndCount(m.messageSize))
+}
+
+func TestMessageConsumedIsLabeledByResult(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewMetrics()
+	m.MessageConsumed("ok")
+	m.MessageConsumed("ok")
+	m.MessageConsumed("not_found")
+
+	assert.Equal(float64(2), testutil.ToFloat64(m.messagesConsumedTotal.WithLabelValues("ok")))
+	assert.Equal(float64(1), testutil.ToFloat64(m.messagesConsumedTotal.WithLabelValues("not_found")))
+}
+
+func TestSaveRejectedIsLabeledByReason(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewMetrics()
+	m.SaveRejected("too_big")
+
+	assert.Equal(float64(1), testutil.ToFloat64(m.saveRejectedTotal.WithLabelValues("too_big")))
+	assert.Equal(float64(0), testutil.ToFloat64(m.saveRejectedTotal.WithLabelValues("rate_limit")))
+}
+
+func TestGaugeSetters(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewMetrics()
+	m.SetMessagesStored(7)
+	m.SetAttachmentsStoredBytes(1024)
+	m.SetUsersTotal(3)
+
+	assert.Equal(float64(7), testutil.ToFloat64(m.messagesStored))
+	assert.Equal(float64(1024), testutil.ToFloat64(m.attachmentsStoredBytes))
+	assert.Equal(float64(3), testutil.ToFloat64(m.usersTotal))
+}
+
+func TestObserveRequestDurationIsLabeledByHandler(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewMetrics()
+	m.ObserveRequestDuration("/save", 10*time.Millisecond)
+
+	assert.Equal(uint64(1), testutil.CollectAndCount(m.requestDuration))
+}
+
+func TestHandlerServesRegisteredMetrics(t *testing.T) {
+	assert := require.New(t)
+
+	m := NewMetrics()
+	m.MessageCreated(1)
+
+	handler := m.Handler()
+	assert.NotNil(handler)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(200, recorder.Code)
+	assert.Contains(recorder.Body.String(), "messages_created_total 1")
+}
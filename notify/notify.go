@@ -0,0 +1,89 @@
+// Package notify lets a sender's browser learn, over a WebSocket, the
+// moment their message is consumed or expires. Connecting requires a
+// short-lived HMAC "notification secret" handed back by /save, so a
+// message token can't be used as an oracle to poll for whether a message
+// still exists.
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SignSecret returns a notification secret for messageToken, valid until
+// validUntil (a Unix timestamp), signed with key.
+func SignSecret(key []byte, messageToken string, validUntil int64) string {
+	return strconv.FormatInt(validUntil, 10) + "." + sign(key, messageToken, validUntil)
+}
+
+// VerifySecret reports whether secret is a still-valid SignSecret output
+// for messageToken.
+func VerifySecret(key []byte, messageToken string, secret string) bool {
+	validUntilText, signature, found := strings.Cut(secret, ".")
+	if !found {
+		return false
+	}
+
+	validUntil, err := strconv.ParseInt(validUntilText, 10, 64)
+	if err != nil || time.Now().Unix() > validUntil {
+		return false
+	}
+
+	return hmac.Equal([]byte(signature), []byte(sign(key, messageToken, validUntil)))
+}
+
+func sign(key []byte, messageToken string, validUntil int64) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(messageToken))
+	mac.Write([]byte(":"))
+	mac.Write([]byte(strconv.FormatInt(validUntil, 10)))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Event is broadcast to every waiter on a message token once it's resolved.
+type Event struct {
+	Event string `json:"event"`
+}
+
+// Hub tracks the open WebSocket connections waiting on each message token,
+// so a single consume or expiry can fan out to all of them.
+type Hub struct {
+	mutex   sync.Mutex
+	waiters map[string][]*websocket.Conn
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{waiters: make(map[string][]*websocket.Conn)}
+}
+
+// Wait registers conn as waiting on messageToken; it is sent an Event and
+// closed the next time Broadcast is called for that token.
+func (h *Hub) Wait(messageToken string, conn *websocket.Conn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.waiters[messageToken] = append(h.waiters[messageToken], conn)
+}
+
+// Broadcast sends event to every connection waiting on messageToken, closes
+// them, and forgets about the token. It's a no-op if nobody is waiting.
+func (h *Hub) Broadcast(messageToken string, event string) {
+	h.mutex.Lock()
+	conns := h.waiters[messageToken]
+	delete(h.waiters, messageToken)
+	h.mutex.Unlock()
+
+	for _, conn := range conns {
+		_ = conn.WriteJSON(Event{Event: event})
+		_ = conn.Close()
+	}
+}
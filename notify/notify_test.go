@@ -0,0 +1,58 @@
+package notify
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySecretAcceptsItsOwnSignature(t *testing.T) {
+	assert := require.New(t)
+
+	key := []byte("test-key")
+	validUntil := time.Now().Add(time.Hour).Unix()
+	secret := SignSecret(key, "tok1", validUntil)
+
+	assert.True(VerifySecret(key, "tok1", secret))
+}
+
+func TestVerifySecretRejectsWrongToken(t *testing.T) {
+	assert := require.New(t)
+
+	key := []byte("test-key")
+	validUntil := time.Now().Add(time.Hour).Unix()
+	secret := SignSecret(key, "tok1", validUntil)
+
+	assert.False(VerifySecret(key, "tok2", secret))
+}
+
+func TestVerifySecretRejectsWrongKey(t *testing.T) {
+	assert := require.New(t)
+
+	validUntil := time.Now().Add(time.Hour).Unix()
+	secret := SignSecret([]byte("key-a"), "tok1", validUntil)
+
+	assert.False(VerifySecret([]byte("key-b"), "tok1", secret))
+}
+
+func TestVerifySecretRejectsExpired(t *testing.T) {
+	assert := require.New(t)
+
+	key := []byte("test-key")
+	validUntil := time.Now().Add(-time.Hour).Unix()
+	secret := SignSecret(key, "tok1", validUntil)
+
+	assert.False(VerifySecret(key, "tok1", secret))
+}
+
+func TestVerifySecretRejectsMalformed(t *testing.T) {
+	assert := require.New(t)
+
+	assert.False(VerifySecret([]byte("test-key"), "tok1", "not-a-valid-secret"))
+}
+
+func TestBroadcastIsANoOpWithNoWaiters(t *testing.T) {
+	h := NewHub()
+	h.Broadcast("no-such-token", "consumed")
+}
@@ -0,0 +1,124 @@
+package ratelimit
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowSaveRespectsBurst(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{
+		SaveRatePerSecond: 1,
+		SaveBurst:         2,
+		VisitorTTL:        time.Minute,
+	})
+
+	assert.True(limiter.AllowSave("1.2.3.4"))
+	assert.True(limiter.AllowSave("1.2.3.4"))
+	assert.False(limiter.AllowSave("1.2.3.4"))
+}
+
+func TestAllowSaveIsPerVisitor(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{
+		SaveRatePerSecond: 1,
+		SaveBurst:         1,
+		VisitorTTL:        time.Minute,
+	})
+
+	assert.True(limiter.AllowSave("1.1.1.1"))
+	assert.False(limiter.AllowSave("1.1.1.1"))
+	// a different IP gets its own bucket
+	assert.True(limiter.AllowSave("2.2.2.2"))
+}
+
+func TestAllowSaveIsUnlimitedWithZeroValueConfig(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{VisitorTTL: time.Minute})
+
+	for i := 0; i < 100; i++ {
+		assert.True(limiter.AllowSave("1.2.3.4"))
+	}
+}
+
+func TestAllowSaveIsUnlimitedWithZeroBurst(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{
+		SaveRatePerSecond: 1,
+		VisitorTTL:        time.Minute,
+	})
+
+	assert.True(limiter.AllowSave("1.2.3.4"))
+	assert.True(limiter.AllowSave("1.2.3.4"))
+}
+
+func TestConsumeLimiterIsIndependentOfSaveLimiter(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{
+		SaveRatePerSecond:    1,
+		SaveBurst:            1,
+		ConsumeRatePerSecond: 1,
+		ConsumeBurst:         1,
+		VisitorTTL:           time.Minute,
+	})
+
+	assert.True(limiter.AllowSave("1.1.1.1"))
+	assert.False(limiter.AllowSave("1.1.1.1"))
+	// exhausting the save bucket must not affect the consume bucket
+	assert.True(limiter.AllowConsume("1.1.1.1"))
+}
+
+func TestEvictStaleRemovesOnlyOldVisitors(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{
+		SaveRatePerSecond: 1,
+		SaveBurst:         1,
+		VisitorTTL:        10 * time.Millisecond,
+	})
+
+	limiter.AllowSave("stale")
+	limiter.visitors["stale"].seen = time.Now().Add(-time.Hour)
+
+	limiter.AllowSave("fresh")
+
+	limiter.evictStale()
+
+	assert.NotContains(limiter.visitors, "stale")
+	assert.Contains(limiter.visitors, "fresh")
+}
+
+func TestClientIPUsesTrustedProxyHeader(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{
+		TrustedProxyHeaders: []string{"X-Forwarded-For"},
+	})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.Nil(err)
+	r.RemoteAddr = "10.0.0.1:12345"
+	r.Header.Set("X-Forwarded-For", "203.0.113.5, 10.0.0.1")
+
+	assert.Equal("203.0.113.5", limiter.ClientIP(r))
+}
+
+func TestClientIPFallsBackToRemoteAddr(t *testing.T) {
+	assert := require.New(t)
+
+	limiter := NewLimiter(Config{})
+
+	r, err := http.NewRequest("GET", "/", nil)
+	assert.Nil(err)
+	r.RemoteAddr = "198.51.100.7:54321"
+
+	assert.Equal("198.51.100.7", limiter.ClientIP(r))
+}